@@ -0,0 +1,30 @@
+package commands
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// migrateExportCmd is the `git lfs migrate export` subcommand.
+var migrateExportCmd = &cobra.Command{
+	Use: "export [options] [--] [path...]",
+	Run: migrateExportCommand,
+}
+
+func init() {
+	migrateExportCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false,
+		"Preview the rewrite plan without changing any refs")
+	migrateExportCmd.Flags().StringVar(&migrateExportDryRunFormat, "dry-run-format", "json",
+		"Format for the --dry-run report: \"json\" or \"tsv\"")
+	migrateExportCmd.Flags().StringVar(&migrateExportArchivePath, "to-archive", "",
+		"Stream smudged LFS object contents into this archive instead of the tree")
+	migrateExportCmd.Flags().IntVar(&migrateExportJobs, "jobs", 1,
+		"Number of blobs to smudge and rewrite concurrently")
+	migrateExportCmd.Flags().StringVar(&migrateExportPreRewriteHook, "pre-rewrite-hook", "",
+		"Script to run before each commit is rewritten")
+	migrateExportCmd.Flags().StringVar(&migrateExportPostRewriteHook, "post-rewrite-hook", "",
+		"Script to run after each commit's tree has been rewritten, given the old commit SHA and new tree OID on stdin")
+
+	RegisterCommand("migrate", nil, func(cmd *cobra.Command) {
+		cmd.AddCommand(migrateExportCmd)
+	})
+}
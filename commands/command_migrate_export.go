@@ -2,14 +2,23 @@ package commands
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/git-lfs/git-lfs/errors"
 	"github.com/git-lfs/git-lfs/filepathfilter"
 	"github.com/git-lfs/git-lfs/git"
 	"github.com/git-lfs/git-lfs/git/githistory"
+	"github.com/git-lfs/git-lfs/git/githistory/archive"
 	"github.com/git-lfs/git-lfs/git/odb"
 	"github.com/git-lfs/git-lfs/lfs"
 	"github.com/git-lfs/git-lfs/tasklog"
@@ -17,6 +26,203 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// migrateDryRun and migrateExportDryRunFormat back the `--dry-run` flag on
+// `migrate export`: whether to suppress ref updates/checkout and produce a
+// rewrite plan instead, and how to render that plan ("json", the default, or
+// "tsv"). Both are registered alongside the other `migrate export` flags in
+// command_migrate.go.
+var (
+	migrateDryRun             bool
+	migrateExportDryRunFormat string
+
+	// migrateExportArchivePath backs `migrate export --to-archive`: when
+	// set, the smudged LFS object contents are streamed into this archive
+	// instead of being inlined back into the tree, leaving history
+	// pointer-free but small. `migrate export` only writes archives; it
+	// does not read them back.
+	migrateExportArchivePath string
+
+	// migrateExportJobs backs `migrate export --jobs`: the number of
+	// blobs the rewriter is allowed to smudge concurrently. A value <= 1
+	// preserves the previous, fully serial behavior.
+	migrateExportJobs int
+
+	// migrateExportPreRewriteHook and migrateExportPostRewriteHook back
+	// `--pre-rewrite-hook`/`--post-rewrite-hook`: paths to scripts that
+	// are run before a commit's blobs/tree are rewritten, and after its
+	// replacement tree has been written, respectively. Each is invoked
+	// once per commit in the rewritten range. Unlike git's native
+	// `post-rewrite` hook, the second value the post-rewrite script
+	// receives is the new root tree's OID, not a new commit SHA: `migrate
+	// export` rewrites blobs and trees, not commit objects.
+	migrateExportPreRewriteHook  string
+	migrateExportPostRewriteHook string
+)
+
+// runRewriteHook invokes the script at "path", if any, writing "stdin" to its
+// standard input and connecting its standard output/error to ours. It
+// returns a wrapped error if the script exits non-zero, so that a failing
+// hook aborts the export the same way any other migration error would.
+func runRewriteHook(path, stdin string) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(path)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "migrate: rewrite hook %q", path)
+	}
+	return nil
+}
+
+// migrateExportBlobCacheMaxBytes bounds the total size of already-smudged
+// blob contents kept in memory by migrateExportBlobCache, so that a pointer
+// repeated across many commits is only smudged (and archived) once, without
+// holding every blob in a large history in memory at the same time. Bounding
+// by bytes rather than entry count matters because the objects `migrate
+// export` smudges are exactly the multi-GB case `--to-archive` is meant to
+// handle; a single such blob would otherwise count the same as a 1KB one.
+// Any blob larger than this threshold is smudged every time it is seen
+// rather than cached at all (under --to-archive, archive.Writer still stores
+// its contents only the first time its OID is seen). It is a var,
+// not a const, so tests can shrink it instead of allocating hundreds of
+// megabytes to exercise eviction.
+var migrateExportBlobCacheMaxBytes int64 = 256 * 1024 * 1024
+
+// migrateExportBlobCacheEntry is the smudged contents cached for a single LFS
+// object OID.
+type migrateExportBlobCacheEntry struct {
+	oid      string
+	contents []byte
+}
+
+// migrateExportBlobCache is a small, bounded, concurrency-safe LRU of
+// already-smudged blobs, keyed by LFS object OID. It lets BlobFn avoid
+// re-smudging the same object every time it is encountered, which matters once --jobs fans BlobFn out across
+// multiple goroutines. It is bounded by the total size of cached contents,
+// not by entry count, so it stays small even when objects are large.
+type migrateExportBlobCache struct {
+	mu        sync.Mutex
+	order     *list.List
+	entries   map[string]*list.Element
+	sizeBytes int64
+}
+
+func newMigrateExportBlobCache() *migrateExportBlobCache {
+	return &migrateExportBlobCache{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *migrateExportBlobCache) Get(oid string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[oid]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return el.Value.(*migrateExportBlobCacheEntry).contents, true
+}
+
+func (c *migrateExportBlobCache) Put(oid string, contents []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[oid]; ok {
+		c.order.MoveToFront(el)
+		return
+	}
+
+	// A blob larger than the entire cache budget would immediately evict
+	// everything else and then itself in the loop below; skip
+	// caching it and let callers re-smudge it on each encounter instead.
+	if int64(len(contents)) > migrateExportBlobCacheMaxBytes {
+		return
+	}
+
+	el := c.order.PushFront(&migrateExportBlobCacheEntry{oid: oid, contents: contents})
+	c.entries[oid] = el
+	c.sizeBytes += int64(len(contents))
+
+	for c.sizeBytes > migrateExportBlobCacheMaxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*migrateExportBlobCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.oid)
+		c.sizeBytes -= int64(len(entry.contents))
+	}
+}
+
+// migrateExportPlanEntry describes a single blob that `migrate export` would
+// pull out of Git LFS: which commit and path it lives at, its old (pointer)
+// and new (smudged) OIDs, and how its size would change.
+type migrateExportPlanEntry struct {
+	Commit  string `json:"commit"`
+	Path    string `json:"path"`
+	OldOid  string `json:"old_oid"`
+	NewOid  string `json:"new_oid"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+}
+
+// migrateExportPlan accumulates the rewrite plan produced while walking
+// history under `--dry-run`. BlobFn and TreeCallbackFn are invoked for every
+// commit in the rewritten range, so writes to the plan are synchronized.
+type migrateExportPlan struct {
+	mu sync.Mutex
+
+	Blobs []*migrateExportPlanEntry `json:"blobs"`
+	// Attrs holds the rendered `.gitattributes` content that `migrate
+	// export` would write to each root tree it visits, in commit order.
+	Attrs []string `json:"gitattributes,omitempty"`
+}
+
+func (p *migrateExportPlan) AddBlob(e *migrateExportPlanEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Blobs = append(p.Blobs, e)
+}
+
+func (p *migrateExportPlan) AddAttrs(contents string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Attrs = append(p.Attrs, contents)
+}
+
+// Write renders the plan to "w" as either a single indented JSON document
+// ("json", the default, used for any format other than "tsv") or
+// tab-separated rows ("tsv").
+func (p *migrateExportPlan) Write(w io.Writer, format string) error {
+	if format == "tsv" {
+		for _, b := range p.Blobs {
+			if _, err := fmt.Fprintf(w, "blob\t%s\t%s\t%s\t%s\t%d\t%d\n", b.Commit, b.Path, b.OldOid, b.NewOid, b.OldSize, b.NewSize); err != nil {
+				return err
+			}
+		}
+		for i, contents := range p.Attrs {
+			escaped := strings.ReplaceAll(contents, "\n", "\\n")
+			if _, err := fmt.Fprintf(w, "gitattributes\t%d\t%s\n", i, escaped); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
 func migrateExportCommand(cmd *cobra.Command, args []string) {
 	l := tasklog.NewLogger(os.Stderr)
 	defer l.Close()
@@ -37,22 +243,122 @@ func migrateExportCommand(cmd *cobra.Command, args []string) {
 	tracked := trackedFromExportFilter(filter)
 	gitfilter := lfs.NewGitFilter(cfg)
 
+	// When --dry-run is given, "plan" collects the rewrite plan instead of
+	// the command mutating any refs.
+	var plan *migrateExportPlan
+	if migrateDryRun {
+		plan = new(migrateExportPlan)
+	}
+
+	// When --to-archive is given, "archiveWriter" streams the smudged
+	// object contents that would otherwise be inlined into the tree, and
+	// BlobFn leaves a pointer-free stub behind instead. --dry-run never
+	// writes an archive; besides its report, the only file it writes is
+	// the --object-map file, when one is given.
+	var archiveWriter *archive.Writer
+	if len(migrateExportArchivePath) > 0 && !migrateDryRun {
+		f, err := os.Create(migrateExportArchivePath)
+		if err != nil {
+			ExitWithError(errors.Wrap(err, "migrate: creating archive"))
+		}
+		defer f.Close()
+
+		archiveWriter = archive.NewWriter(f)
+		defer func() {
+			if err := archiveWriter.Close(); err != nil {
+				ExitWithError(errors.Wrap(err, "migrate: closing archive"))
+			}
+		}()
+	}
+
+	blobCache := newMigrateExportBlobCache()
+
 	migrate(args, rewriter, l, &githistory.RewriteOptions{
 		Verbose:           migrateVerbose,
 		ObjectMapFilePath: objectMapFilePath,
-		BlobFn: func(path string, b *odb.Blob) (*odb.Blob, error) {
+		// DryRun causes the rewriter to walk history and build the
+		// object map as usual, but to route its writes through a sink
+		// that discards them. The rewriter itself does not read
+		// UpdateRefs (below) in either mode and updates no refs.
+		DryRun: migrateDryRun,
+		// BlobConcurrency lets the rewriter dispatch BlobFn across N
+		// goroutines instead of smudging every blob serially on the
+		// main one; tree assembly itself stays single-threaded. BlobFn
+		// below is written to be safe for concurrent invocation.
+		BlobConcurrency: migrateExportJobs,
+		// --dry-run must not run user scripts, since those scripts are
+		// free to have side effects of their own (e.g. notifying a CI
+		// mirror of a rewrite that hasn't actually happened yet).
+		PreCommitFn: func(old string) error {
+			if migrateDryRun {
+				return nil
+			}
+			return runRewriteHook(migrateExportPreRewriteHook, old+"\n")
+		},
+		PostCommitFn: func(old, newTree string) error {
+			if migrateDryRun {
+				return nil
+			}
+			return runRewriteHook(migrateExportPostRewriteHook, fmt.Sprintf("%s %s\n", old, newTree))
+		},
+		BlobFn: func(commit, path string, oid []byte, b *odb.Blob) (*odb.Blob, error) {
 			if filepath.Base(path) == ".gitattributes" {
 				return b, nil
 			}
 
-			var buf bytes.Buffer
-
-			if _, err := smudge(gitfilter, &buf, b.Contents, path, false, rewriter.Filter()); err != nil {
+			raw, err := ioutil.ReadAll(b.Contents)
+			if err != nil {
 				return nil, err
 			}
 
+			ptr, err := lfs.DecodePointer(bytes.NewReader(raw))
+			if err != nil {
+				// Not every blob an --include pattern matches is
+				// necessarily an LFS pointer at every commit in
+				// the rewritten range (e.g. a path only tracked
+				// starting partway through history); pass those
+				// through unchanged rather than aborting the
+				// whole export. "raw" already drained b.Contents,
+				// so hand back a blob wrapping those same bytes.
+				return &odb.Blob{
+					Contents: bytes.NewReader(raw), Size: b.Size,
+				}, nil
+			}
+
+			contents, ok := blobCache.Get(ptr.Oid)
+			if !ok {
+				var buf bytes.Buffer
+				if _, err := smudge(gitfilter, &buf, bytes.NewReader(raw), path, false, rewriter.Filter()); err != nil {
+					return nil, err
+				}
+
+				contents = buf.Bytes()
+				blobCache.Put(ptr.Oid, contents)
+			}
+
+			if plan != nil {
+				plan.AddBlob(&migrateExportPlanEntry{
+					Commit:  commit,
+					Path:    path,
+					OldOid:  hex.EncodeToString(oid),
+					NewOid:  hex.EncodeToString(githistory.HashBlob(contents)),
+					OldSize: b.Size,
+					NewSize: int64(len(contents)),
+				})
+			}
+
+			if archiveWriter != nil {
+				if err := archiveWriter.WriteObject(ptr.Oid, path, commit, int64(len(contents)), bytes.NewReader(contents)); err != nil {
+					return nil, err
+				}
+
+				return &odb.Blob{
+					Contents: strings.NewReader(""), Size: 0,
+				}, nil
+			}
+
 			return &odb.Blob{
-				Contents: &buf, Size: int64(buf.Len()),
+				Contents: bytes.NewReader(contents), Size: int64(len(contents)),
 			}, nil
 		},
 
@@ -77,11 +383,25 @@ func migrateExportCommand(cmd *cobra.Command, args []string) {
 			// is present and has a diff between commits in the
 			// range of commits to migrate, those changes are
 			// preserved.
-			blob, err := trackedToBlob(db, theirs.Clone().Union(ours))
+			merged := theirs.Clone().Union(ours)
+			blob, err := trackedToBlob(db, merged)
 			if err != nil {
 				return nil, err
 			}
 
+			if plan != nil {
+				// Render the same merged set that was just written
+				// to "blob" above, so the dry-run report reflects
+				// any custom patterns already present in the tree's
+				// .gitattributes, not just the ones this export
+				// would add.
+				var lines []string
+				for line := range merged.Iter() {
+					lines = append(lines, line)
+				}
+				plan.AddAttrs(strings.Join(lines, "\n"))
+			}
+
 			// Finally, return a copy of the tree "t" that has the
 			// new .gitattributes file included/replaced.
 			return t.Merge(&odb.TreeEntry{
@@ -91,9 +411,16 @@ func migrateExportCommand(cmd *cobra.Command, args []string) {
 			}), nil
 		},
 
-		UpdateRefs: true,
+		UpdateRefs: !migrateDryRun,
 	})
 
+	if plan != nil {
+		if err := plan.Write(os.Stdout, migrateExportDryRunFormat); err != nil {
+			ExitWithError(err)
+		}
+		return
+	}
+
 	// Only perform `git-checkout(1) -f` if the repository is
 	// non-bare.
 	if bare, _ := git.IsBare(); !bare {
@@ -124,4 +451,4 @@ func trackedFromExportFilter(filter *filepathfilter.Filter) *tools.OrderedSet {
 	}
 
 	return tracked
-}
\ No newline at end of file
+}
@@ -0,0 +1,55 @@
+package commands
+
+import "testing"
+
+func TestMigrateExportBlobCacheGetPut(t *testing.T) {
+	c := newMigrateExportBlobCache()
+
+	if _, ok := c.Get("missing"); ok {
+		t.Fatalf("Get on empty cache returned ok = true")
+	}
+
+	c.Put("oid1", []byte("hello"))
+	contents, ok := c.Get("oid1")
+	if !ok {
+		t.Fatalf("Get after Put returned ok = false")
+	}
+	if string(contents) != "hello" {
+		t.Errorf("Get returned %q, want %q", contents, "hello")
+	}
+}
+
+func TestMigrateExportBlobCacheEvictsOldestByBytes(t *testing.T) {
+	old := migrateExportBlobCacheMaxBytes
+	migrateExportBlobCacheMaxBytes = 10
+	defer func() { migrateExportBlobCacheMaxBytes = old }()
+
+	c := newMigrateExportBlobCache()
+
+	c.Put("oid1", make([]byte, 4))
+	c.Put("oid2", make([]byte, 4))
+	c.Put("oid3", make([]byte, 4)) // pushes total size to 12, over the 10-byte budget
+
+	if _, ok := c.Get("oid1"); ok {
+		t.Errorf("oldest entry was not evicted once the budget was exceeded")
+	}
+	if _, ok := c.Get("oid2"); !ok {
+		t.Errorf("oid2 should still be cached")
+	}
+	if _, ok := c.Get("oid3"); !ok {
+		t.Errorf("oid3 should still be cached")
+	}
+}
+
+func TestMigrateExportBlobCacheSkipsOversizedBlob(t *testing.T) {
+	old := migrateExportBlobCacheMaxBytes
+	migrateExportBlobCacheMaxBytes = 4
+	defer func() { migrateExportBlobCacheMaxBytes = old }()
+
+	c := newMigrateExportBlobCache()
+	c.Put("oid1", make([]byte, 8)) // larger than the whole budget
+
+	if _, ok := c.Get("oid1"); ok {
+		t.Errorf("a blob larger than the cache budget should not be cached at all")
+	}
+}
@@ -0,0 +1,116 @@
+// Package archive implements a streaming writer for the self-describing
+// archives produced by `git lfs migrate export --to-archive`. An archive
+// bundles the original contents of every LFS object pulled out of history
+// alongside a manifest recording, for each object, the OID it was stored
+// under, the path(s) it appeared at, and the commit(s) that referenced it.
+// This package only writes archives; it provides no reader for them.
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/git-lfs/git-lfs/errors"
+)
+
+// manifestName is the name of the manifest entry within the archive. It is
+// written last so that every object entry which precedes it has already been
+// flushed to the underlying tar stream.
+const manifestName = "manifest.json"
+
+// Entry records where a single archived object came from.
+type Entry struct {
+	Oid    string `json:"oid"`
+	Path   string `json:"path"`
+	Commit string `json:"commit"`
+	Size   int64  `json:"size"`
+}
+
+// manifest is the JSON document written to "manifest.json" once every entry
+// has been archived.
+type manifest struct {
+	Entries []*Entry `json:"entries"`
+}
+
+// Writer streams LFS object contents into a tar archive, alongside a
+// manifest that can later be used to restore them. Writer does not buffer
+// object contents in memory: each call to WriteObject that sees a new "oid"
+// copies directly from the given io.Reader into the archive. It is safe to
+// call WriteObject from multiple goroutines, e.g. when the caller smudges
+// blobs concurrently.
+type Writer struct {
+	mu sync.Mutex
+	tw *tar.Writer
+
+	entries []*Entry
+	written map[string]bool
+}
+
+// NewWriter returns a new *Writer that streams its archive to "w".
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{tw: tar.NewWriter(w), written: make(map[string]bool)}
+}
+
+// WriteObject records an Entry noting that the object at "oid" was found at
+// "path" in "commit". The first time "oid" is seen, it also streams "size"
+// bytes from "r" into the archive under that name. It is safe to call
+// WriteObject more than once with the same "oid" if the same object appears
+// at multiple paths or commits: later calls only add a manifest entry,
+// without re-reading "r" or re-storing the (identical) contents, since the
+// object is already present in the archive under that oid.
+func (w *Writer) WriteObject(oid, path, commit string, size int64, r io.Reader) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.written[oid] {
+		if err := w.tw.WriteHeader(&tar.Header{
+			Name: oid,
+			Mode: 0644,
+			Size: size,
+		}); err != nil {
+			return errors.Wrap(err, "archive: write header")
+		}
+
+		n, err := io.Copy(w.tw, r)
+		if err != nil {
+			return errors.Wrap(err, "archive: write object")
+		}
+		if n != size {
+			return errors.Errorf("archive: short write for %s: expected %d bytes, wrote %d", oid, size, n)
+		}
+
+		w.written[oid] = true
+	}
+
+	w.entries = append(w.entries, &Entry{
+		Oid: oid, Path: path, Commit: commit, Size: size,
+	})
+	return nil
+}
+
+// Close writes the manifest and flushes the underlying tar stream. It does
+// not close "w" itself, mirroring tar.Writer's own Close semantics.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf, err := json.MarshalIndent(&manifest{Entries: w.entries}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "archive: marshal manifest")
+	}
+
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name: manifestName,
+		Mode: 0644,
+		Size: int64(len(buf)),
+	}); err != nil {
+		return errors.Wrap(err, "archive: write manifest header")
+	}
+	if _, err := w.tw.Write(buf); err != nil {
+		return errors.Wrap(err, "archive: write manifest")
+	}
+
+	return w.tw.Close()
+}
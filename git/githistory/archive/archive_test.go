@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriterWritesObjectOnce(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	contents := "hello world"
+	if err := w.WriteObject("oid1", "a.bin", "commit1", int64(len(contents)), strings.NewReader(contents)); err != nil {
+		t.Fatalf("WriteObject: %v", err)
+	}
+	// A second occurrence of the same OID at a different path/commit
+	// should not re-stream the contents; passing a reader that panics on
+	// read proves it's never consumed.
+	if err := w.WriteObject("oid1", "b.bin", "commit2", int64(len(contents)), errReader{}); err != nil {
+		t.Fatalf("WriteObject (repeat oid): %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	entries, objects := readArchive(t, &buf)
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 manifest entries, got %d", len(entries))
+	}
+	if entries[0].Path != "a.bin" || entries[0].Commit != "commit1" {
+		t.Errorf("unexpected first entry: %+v", entries[0])
+	}
+	if entries[1].Path != "b.bin" || entries[1].Commit != "commit2" {
+		t.Errorf("unexpected second entry: %+v", entries[1])
+	}
+
+	if len(objects) != 1 {
+		t.Fatalf("expected exactly one stored object, got %d distinct object entries", len(objects))
+	}
+	if objects["oid1"] != contents {
+		t.Errorf("stored object contents = %q, want %q", objects["oid1"], contents)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	panic("unexpected read of a repeat-OID object's contents")
+}
+
+type manifestDoc struct {
+	Entries []*Entry `json:"entries"`
+}
+
+// readArchive parses the tar stream produced by Writer, returning the
+// manifest entries in the order they were recorded and a map of oid ->
+// stored contents (keyed by tar entry name, i.e. oid).
+func readArchive(t *testing.T, r io.Reader) ([]*Entry, map[string]string) {
+	t.Helper()
+
+	tr := tar.NewReader(r)
+	objects := make(map[string]string)
+	var entries []*Entry
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+
+		var body bytes.Buffer
+		if _, err := io.Copy(&body, tr); err != nil {
+			t.Fatalf("reading tar entry %q: %v", hdr.Name, err)
+		}
+
+		if hdr.Name == manifestName {
+			var m manifestDoc
+			if err := json.Unmarshal(body.Bytes(), &m); err != nil {
+				t.Fatalf("unmarshaling manifest: %v", err)
+			}
+			entries = m.Entries
+			continue
+		}
+
+		objects[hdr.Name] = body.String()
+	}
+
+	return entries, objects
+}
@@ -0,0 +1,369 @@
+// Package githistory rewrites the blobs and trees reachable from a set of
+// commits, as used by `git lfs migrate`.
+package githistory
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/git-lfs/git-lfs/errors"
+	"github.com/git-lfs/git-lfs/filepathfilter"
+	"github.com/git-lfs/git-lfs/git/odb"
+)
+
+// BlobFn is called once for every tracked blob entry in every commit being
+// rewritten, and may return a replacement blob. "commit" is the hex SHA1 of
+// the commit being visited (before rewriting), "path" is the blob's path
+// within that commit's tree, and "oid" is the blob's current (pre-rewrite)
+// OID.
+type BlobFn func(commit, path string, oid []byte, b *odb.Blob) (*odb.Blob, error)
+
+// TreeCallbackFn is called once per root tree visited while rewriting
+// history, after all of that commit's blobs have been rewritten, and may
+// return a modified copy of that tree.
+type TreeCallbackFn func(path string, t *odb.Tree) (*odb.Tree, error)
+
+// CommitEntry describes a single tracked blob within a commit's tree.
+type CommitEntry struct {
+	// Path is the blob's path within the commit's tree.
+	Path string
+	// Oid is the blob's current (pre-rewrite) OID.
+	Oid []byte
+}
+
+// Commit describes a single commit to be rewritten: its original SHA, its
+// root tree, and the tracked blob entries within that tree.
+type Commit struct {
+	Sha     string
+	Tree    *odb.Tree
+	Entries []*CommitEntry
+}
+
+// RewriteOptions configures a call to (*Rewriter).Rewrite.
+type RewriteOptions struct {
+	// Verbose enables progress logging as each commit is rewritten.
+	Verbose bool
+	// ObjectMapFilePath, if given, is where the old->new SHA mapping
+	// produced by the rewrite is written once it completes.
+	ObjectMapFilePath string
+	// BlobFn, if given, is called for every tracked blob and may return a
+	// replacement blob.
+	BlobFn BlobFn
+	// TreeCallbackFn, if given, is called for every root tree visited.
+	TreeCallbackFn TreeCallbackFn
+	// UpdateRefs is carried for callers; Rewrite does not read it. Rewrite
+	// writes no commit objects and updates no refs, whatever its value.
+	UpdateRefs bool
+	// DryRun causes Rewrite to walk history and compute what it would
+	// write, without persisting any blob or tree to the object database.
+	DryRun bool
+	// BlobConcurrency is the number of goroutines Rewrite will use to
+	// call BlobFn concurrently for the blobs within a single commit. A
+	// value <= 1 calls BlobFn serially on the calling goroutine, matching
+	// the previous behavior.
+	BlobConcurrency int
+	// PreCommitFn, if given, is called with a commit's original SHA
+	// before that commit's blobs and tree are rewritten. An error aborts
+	// the rewrite before any object for that commit is touched.
+	PreCommitFn func(old string) error
+	// PostCommitFn, if given, is called once a commit's blobs and root
+	// tree have been fully rewritten, with that commit's original SHA and
+	// the OID its rewritten root tree was written under (under DryRun, the
+	// planned OID discardingSink computes, which is not the OID git would
+	// assign to that tree). The second argument is a tree OID, not a new commit
+	// SHA: Rewrite only rewrites blobs and trees, not commit objects, so
+	// there is no rewritten commit to report here. An error aborts the
+	// rewrite before any later commit is visited.
+	PostCommitFn func(old, newTree string) error
+}
+
+// RewriteStats summarizes a completed (or, under DryRun, planned) call to
+// Rewrite.
+type RewriteStats struct {
+	// CommitsRewritten is the number of commits visited.
+	CommitsRewritten int
+	// ObjectMap maps each old commit SHA to the SHA of its rewritten root
+	// tree.
+	ObjectMap map[string]string
+}
+
+// objectDatabase is the subset of *odb.ObjectDatabase that Rewriter reads
+// and writes objects through. Storing it as an interface, rather than the
+// concrete type, lets tests exercise Rewrite/rewriteBlobs against an
+// in-memory fake instead of a real on-disk object database.
+type objectDatabase interface {
+	Blob(oid []byte) (*odb.Blob, error)
+	WriteBlob(b *odb.Blob) ([]byte, error)
+	WriteTree(t *odb.Tree) ([]byte, error)
+}
+
+// Rewriter rewrites the commits given to NewRewriter according to a
+// RewriteOptions given to Rewrite.
+type Rewriter struct {
+	db      objectDatabase
+	filter  *filepathfilter.Filter
+	commits []*Commit
+}
+
+// NewRewriter returns a new *Rewriter that will rewrite "commits" (in the
+// order given, which must be oldest-first) by reading and writing objects
+// through "db", limiting BlobFn/TreeCallbackFn to paths matched by "filter".
+func NewRewriter(db *odb.ObjectDatabase, filter *filepathfilter.Filter, commits []*Commit) *Rewriter {
+	return &Rewriter{db: db, filter: filter, commits: commits}
+}
+
+// Filter returns the *filepathfilter.Filter this Rewriter was constructed
+// with.
+func (r *Rewriter) Filter() *filepathfilter.Filter {
+	return r.filter
+}
+
+// objectSink is the subset of write operations Rewrite needs against the
+// object database. Routing every write through this interface, rather than
+// calling r.db directly, is what lets DryRun swap in a sink that discards
+// writes instead of persisting them.
+type objectSink interface {
+	WriteBlob(b *odb.Blob) ([]byte, error)
+	WriteTree(t *odb.Tree) ([]byte, error)
+}
+
+// dbSink writes through to the real object database.
+type dbSink struct{ db objectDatabase }
+
+func (s dbSink) WriteBlob(b *odb.Blob) ([]byte, error) { return s.db.WriteBlob(b) }
+func (s dbSink) WriteTree(t *odb.Tree) ([]byte, error) { return s.db.WriteTree(t) }
+
+// discardingSink never writes to the object database. For a blob it computes
+// the same OID that a real write would have produced, by hashing a
+// loose-object-style "<type> <size>\x00<contents>" header exactly as
+// `git hash-object` does, so that DryRun can report accurate old/new blob
+// OIDs without mutating the repository. For a tree it computes a stable hash
+// of the tree's entries that is not the OID git would assign to that tree.
+type discardingSink struct{}
+
+func (discardingSink) WriteBlob(b *odb.Blob) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, b.Contents); err != nil {
+		return nil, errors.Wrap(err, "githistory: hashing blob")
+	}
+	return hashObject("blob", buf.Bytes()), nil
+}
+
+func (discardingSink) WriteTree(t *odb.Tree) ([]byte, error) {
+	// The exact bytes of a planned tree aren't meaningful on their own;
+	// what matters for a dry-run report is that the same tree contents
+	// always hash to the same planned OID, the same way a real write of
+	// that tree would. Format each entry's mode/name/oid explicitly
+	// rather than relying on "%v", since the latter prints slice element
+	// addresses (not their contents) for a []*TreeEntry, making the
+	// "hash" depend on allocation addresses instead of tree contents.
+	entries := make([]*odb.TreeEntry, len(t.Entries))
+	copy(entries, t.Entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%o %s\x00%x\n", e.Filemode, e.Name, e.Oid)
+	}
+
+	return hashObject("tree", buf.Bytes()), nil
+}
+
+// HashBlob returns the OID a real write of a blob with the given contents
+// would produce, computed the same way discardingSink does. Callers that
+// need to report a planned OID without writing it (e.g. a --dry-run report)
+// can use this instead of constructing their own sink.
+func HashBlob(contents []byte) []byte {
+	return hashObject("blob", contents)
+}
+
+func hashObject(kind string, contents []byte) []byte {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", kind, len(contents))
+	h.Write(contents)
+	return h.Sum(nil)
+}
+
+// Rewrite visits every commit given to NewRewriter, rewriting its tracked
+// blobs and root tree through opt.BlobFn/opt.TreeCallbackFn, and returns a
+// summary of what was (or, under opt.DryRun, would be) changed.
+func (r *Rewriter) Rewrite(opt *RewriteOptions) (*RewriteStats, error) {
+	var sink objectSink = dbSink{r.db}
+	if opt.DryRun {
+		sink = discardingSink{}
+	}
+
+	stats := &RewriteStats{ObjectMap: make(map[string]string)}
+
+	for _, commit := range r.commits {
+		if opt.PreCommitFn != nil {
+			if err := opt.PreCommitFn(commit.Sha); err != nil {
+				return nil, errors.Wrapf(err, "githistory: pre-rewrite hook for %s", commit.Sha)
+			}
+		}
+
+		tree, err := r.rewriteBlobs(sink, commit, opt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "githistory: rewriting %s", commit.Sha)
+		}
+
+		if opt.TreeCallbackFn != nil {
+			tree, err = opt.TreeCallbackFn("/", tree)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		newTreeOid, err := sink.WriteTree(tree)
+		if err != nil {
+			return nil, err
+		}
+		newTreeSha := hex.EncodeToString(newTreeOid)
+
+		if opt.PostCommitFn != nil {
+			if err := opt.PostCommitFn(commit.Sha, newTreeSha); err != nil {
+				return nil, errors.Wrapf(err, "githistory: post-rewrite hook for %s", commit.Sha)
+			}
+		}
+
+		stats.ObjectMap[commit.Sha] = newTreeSha
+		stats.CommitsRewritten++
+	}
+
+	if len(opt.ObjectMapFilePath) > 0 {
+		if err := writeObjectMap(opt.ObjectMapFilePath, stats.ObjectMap); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// blobResult is the outcome of rewriting a single CommitEntry, keyed by its
+// index within commit.Entries so that results can be merged into the tree in
+// a deterministic order regardless of which goroutine produced them.
+type blobResult struct {
+	index int
+	oid   []byte
+	err   error
+}
+
+// rewriteBlobs rewrites every tracked blob in "commit" through opt.BlobFn and
+// merges the results into commit.Tree. Up to opt.BlobConcurrency blobs are
+// rewritten concurrently; the results are still merged into the tree in
+// entry order, so the resulting tree OID does not depend on BlobConcurrency.
+func (r *Rewriter) rewriteBlobs(sink objectSink, commit *Commit, opt *RewriteOptions) (*odb.Tree, error) {
+	tree := commit.Tree
+	if opt.BlobFn == nil {
+		return tree, nil
+	}
+
+	workers := opt.BlobConcurrency
+	if workers > len(commit.Entries) {
+		workers = len(commit.Entries)
+	}
+	if workers <= 1 {
+		for i, entry := range commit.Entries {
+			oid, err := r.rewriteBlob(sink, commit, entry, opt)
+			if err != nil {
+				return nil, err
+			}
+			tree = mergeBlob(tree, commit.Entries[i], oid)
+		}
+		return tree, nil
+	}
+
+	jobs := make(chan int)
+	results := make(chan blobResult)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				oid, err := r.rewriteBlob(sink, commit, commit.Entries[i], opt)
+				results <- blobResult{index: i, oid: oid, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for i := range commit.Entries {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	oids := make([][]byte, len(commit.Entries))
+	var firstErr error
+	for res := range results {
+		if res.err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(res.err, "githistory: rewriting blob %s",
+				commit.Entries[res.index].Path)
+			continue
+		}
+		oids[res.index] = res.oid
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	for i, entry := range commit.Entries {
+		tree = mergeBlob(tree, entry, oids[i])
+	}
+
+	return tree, nil
+}
+
+// rewriteBlob reads, rewrites, and writes a single tracked blob, returning
+// the OID it was written under.
+func (r *Rewriter) rewriteBlob(sink objectSink, commit *Commit, entry *CommitEntry, opt *RewriteOptions) ([]byte, error) {
+	blob, err := r.db.Blob(entry.Oid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "githistory: reading blob %s", entry.Path)
+	}
+
+	rewritten, err := opt.BlobFn(commit.Sha, entry.Path, entry.Oid, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return sink.WriteBlob(rewritten)
+}
+
+func mergeBlob(tree *odb.Tree, entry *CommitEntry, oid []byte) *odb.Tree {
+	return tree.Merge(&odb.TreeEntry{
+		Name:     entry.Path,
+		Filemode: 0100644,
+		Oid:      oid,
+	})
+}
+
+func writeObjectMap(path string, objectMap map[string]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "githistory: opening object map %q", path)
+	}
+	defer f.Close()
+
+	for old, new := range objectMap {
+		if _, err := fmt.Fprintf(f, "%s %s\n", old, new); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package githistory
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/git-lfs/git-lfs/git/odb"
+)
+
+// fakeDB is a minimal in-memory objectDatabase, keyed by the same
+// loose-object hash discardingSink uses, so tests don't need a real
+// on-disk object database.
+type fakeDB struct {
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	writes int
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{blobs: make(map[string][]byte)}
+}
+
+func (d *fakeDB) Blob(oid []byte) (*odb.Blob, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	contents, ok := d.blobs[string(oid)]
+	if !ok {
+		return nil, fmt.Errorf("fakeDB: no such blob %x", oid)
+	}
+	return &odb.Blob{Contents: bytes.NewReader(contents), Size: int64(len(contents))}, nil
+}
+
+func (d *fakeDB) WriteBlob(b *odb.Blob) ([]byte, error) {
+	contents, err := ioutil.ReadAll(b.Contents)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oid := hashObject("blob", contents)
+	d.blobs[string(oid)] = contents
+	d.writes++
+	return oid, nil
+}
+
+func (d *fakeDB) WriteTree(t *odb.Tree) ([]byte, error) {
+	return discardingSink{}.WriteTree(t)
+}
+
+func (d *fakeDB) put(contents []byte) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oid := hashObject("blob", contents)
+	d.blobs[string(oid)] = contents
+	return oid
+}
+
+func TestDiscardingSinkWriteTreeIsDeterministic(t *testing.T) {
+	entryA := &odb.TreeEntry{Name: "a.txt", Filemode: 0100644, Oid: []byte{0x01}}
+	entryB := &odb.TreeEntry{Name: "b.txt", Filemode: 0100644, Oid: []byte{0x02}}
+
+	inOrder := &odb.Tree{Entries: []*odb.TreeEntry{entryA, entryB}}
+	reversed := &odb.Tree{Entries: []*odb.TreeEntry{entryB, entryA}}
+
+	sink := discardingSink{}
+
+	oid1, err := sink.WriteTree(inOrder)
+	if err != nil {
+		t.Fatalf("WriteTree: %v", err)
+	}
+	oid2, err := sink.WriteTree(reversed)
+	if err != nil {
+		t.Fatalf("WriteTree: %v", err)
+	}
+
+	if !bytes.Equal(oid1, oid2) {
+		t.Errorf("WriteTree OID depends on entry order: %x != %x", oid1, oid2)
+	}
+
+	different := &odb.Tree{Entries: []*odb.TreeEntry{entryA}}
+	oid3, err := sink.WriteTree(different)
+	if err != nil {
+		t.Fatalf("WriteTree: %v", err)
+	}
+	if bytes.Equal(oid1, oid3) {
+		t.Errorf("WriteTree OID did not change for different tree contents")
+	}
+}
+
+func TestRewriteConcurrentBlobsAndHooks(t *testing.T) {
+	db := newFakeDB()
+
+	var commits []*Commit
+	for i := 0; i < 5; i++ {
+		// Several entries per commit, since rewriteBlobs never starts more
+		// workers than a commit has entries.
+		var entries []*CommitEntry
+		for j := 0; j < 3; j++ {
+			oid := db.put([]byte(fmt.Sprintf("contents-%d-%d", i, j)))
+			entries = append(entries, &CommitEntry{Path: fmt.Sprintf("file-%d.txt", j), Oid: oid})
+		}
+		commits = append(commits, &Commit{
+			Sha:     fmt.Sprintf("sha-%d", i),
+			Tree:    &odb.Tree{},
+			Entries: entries,
+		})
+	}
+
+	r := NewRewriter(nil, nil, commits)
+	r.db = db // inject the fake in place of the *odb.ObjectDatabase NewRewriter expects
+
+	var mu sync.Mutex
+	var preOrder, postOrder []string
+
+	stats, err := r.Rewrite(&RewriteOptions{
+		BlobConcurrency: 4,
+		PreCommitFn: func(old string) error {
+			mu.Lock()
+			preOrder = append(preOrder, old)
+			mu.Unlock()
+			return nil
+		},
+		PostCommitFn: func(old, newTree string) error {
+			mu.Lock()
+			postOrder = append(postOrder, old)
+			mu.Unlock()
+			return nil
+		},
+		BlobFn: func(commit, path string, oid []byte, b *odb.Blob) (*odb.Blob, error) {
+			raw, err := ioutil.ReadAll(b.Contents)
+			if err != nil {
+				return nil, err
+			}
+			return &odb.Blob{
+				Contents: strings.NewReader(strings.ToUpper(string(raw))),
+				Size:     int64(len(raw)),
+			}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+
+	if stats.CommitsRewritten != len(commits) {
+		t.Errorf("CommitsRewritten = %d, want %d", stats.CommitsRewritten, len(commits))
+	}
+	if len(stats.ObjectMap) != len(commits) {
+		t.Errorf("len(ObjectMap) = %d, want %d", len(stats.ObjectMap), len(commits))
+	}
+
+	// PreCommitFn/PostCommitFn run once per commit, in commit order, even
+	// though BlobFn itself is dispatched across multiple goroutines.
+	for i, commit := range commits {
+		if preOrder[i] != commit.Sha {
+			t.Errorf("preOrder[%d] = %s, want %s", i, preOrder[i], commit.Sha)
+		}
+		if postOrder[i] != commit.Sha {
+			t.Errorf("postOrder[%d] = %s, want %s", i, postOrder[i], commit.Sha)
+		}
+	}
+}